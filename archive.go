@@ -0,0 +1,323 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Entry describes one file, directory, or link inside an archive, with its
+// name already decoded to utf8.
+type Entry struct {
+	Name     string
+	Linkname string
+	Mode     os.FileMode
+	ModTime  time.Time
+	IsDir    bool
+	Typeflag byte // archive/tar Type* constants; zip entries are always 0
+
+	zf *zip.File // set for zip entries; Open uses it directly, so it is safe to call concurrently for distinct Entries
+}
+
+// Archive is implemented by the zip and tar backends. Next returns io.EOF
+// once all entries have been consumed.
+type Archive interface {
+	Next() (*Entry, error)
+	Open(ent *Entry) (io.ReadCloser, error)
+	Close() error
+}
+
+// ParallelArchive is implemented by backends that can list every entry up
+// front and open them concurrently from independent readers. Only the zip
+// backend qualifies: archive/tar reads its entries off a single sequential
+// stream.
+type ParallelArchive interface {
+	Archive
+	Entries() ([]*Entry, error)
+}
+
+// openArchive picks a backend for fn by extension, falling back to a magic
+// byte sniff when the extension is not recognized.
+func openArchive(fn string) (Archive, error) {
+	switch archiveKind(fn) {
+	case kindTarGz:
+		f, err := os.Open(fn)
+		if err != nil {
+			return nil, err
+		}
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return newTarArchive(gz, gz, f), nil
+
+	case kindTarBz2:
+		f, err := os.Open(fn)
+		if err != nil {
+			return nil, err
+		}
+		return newTarArchive(bzip2.NewReader(f), f), nil
+
+	case kindTar:
+		f, err := os.Open(fn)
+		if err != nil {
+			return nil, err
+		}
+		return newTarArchive(f, f), nil
+
+	default:
+		return openZipArchive(fn)
+	}
+}
+
+type kind int
+
+const (
+	kindZip kind = iota
+	kindTar
+	kindTarGz
+	kindTarBz2
+)
+
+func archiveKind(fn string) kind {
+	switch {
+	case strings.HasSuffix(fn, ".tar.gz"), strings.HasSuffix(fn, ".tgz"):
+		return kindTarGz
+	case strings.HasSuffix(fn, ".tar.bz2"), strings.HasSuffix(fn, ".tbz2"):
+		return kindTarBz2
+	case strings.HasSuffix(fn, ".tar"):
+		return kindTar
+	case strings.HasSuffix(fn, ".zip"):
+		return kindZip
+	}
+	return sniffKind(fn)
+}
+
+// sniffKind is used when fn's extension is not one we recognize.
+func sniffKind(fn string) kind {
+	f, err := os.Open(fn)
+	if err != nil {
+		return kindZip
+	}
+	defer f.Close()
+
+	var magic [3]byte
+	if _, err := io.ReadFull(f, magic[:]); err != nil {
+		return kindZip
+	}
+	switch {
+	case magic[0] == 0x1f && magic[1] == 0x8b:
+		return kindTarGz
+	case magic[0] == 'B' && magic[1] == 'Z' && magic[2] == 'h':
+		return kindTarBz2
+	case magic[0] == 'P' && magic[1] == 'K':
+		return kindZip
+	}
+	return kindTar
+}
+
+// zipArchive adapts archive/zip to Archive. zip.File.Open derives its own
+// SectionReader per call, so Open is safe to call concurrently for distinct
+// entries, which is what makes zipArchive a ParallelArchive.
+type zipArchive struct {
+	r *zip.ReadCloser
+	i int
+}
+
+func openZipArchive(fn string) (*zipArchive, error) {
+	r, err := zip.OpenReader(fn)
+	if err != nil {
+		return nil, err
+	}
+	return &zipArchive{r: r}, nil
+}
+
+func zipEntry(zf *zip.File) *Entry {
+	return &Entry{
+		Name:    decodeZipName(zf),
+		Mode:    zf.Mode(),
+		ModTime: zf.Modified,
+		IsDir:   zf.Mode().IsDir(),
+		zf:      zf,
+	}
+}
+
+func (a *zipArchive) Next() (*Entry, error) {
+	if a.i >= len(a.r.File) {
+		return nil, io.EOF
+	}
+	zf := a.r.File[a.i]
+	a.i++
+	return zipEntry(zf), nil
+}
+
+func (a *zipArchive) Entries() ([]*Entry, error) {
+	ents := make([]*Entry, len(a.r.File))
+	for i, zf := range a.r.File {
+		ents[i] = zipEntry(zf)
+	}
+	return ents, nil
+}
+
+func (a *zipArchive) Open(ent *Entry) (io.ReadCloser, error) {
+	return ent.zf.Open()
+}
+
+func (a *zipArchive) Close() error {
+	return a.r.Close()
+}
+
+// unicodePathExtraID is the header ID of the Info-ZIP Unicode Path Extra
+// Field, which carries a UTF-8 copy of a filename alongside a legacy-encoded
+// zf.Name.
+const unicodePathExtraID = 0x7075
+
+// decodeZipName returns zf.Name as utf8. If the general purpose bit 11
+// (UTF-8) is set, zf.Name is already utf8. Otherwise it looks for an
+// Info-ZIP Unicode Path extra field whose CRC32 matches zf.Name and prefers
+// that, falling back to the *charset decoder only when neither signal is
+// present.
+func decodeZipName(zf *zip.File) string {
+	if zf.Flags&0x0800 != 0 {
+		return zf.Name
+	}
+
+	if fn, ok := unicodePathFromExtra(zf.Extra, zf.Name); ok {
+		return fn
+	}
+
+	return decodeName(zf.Name)
+}
+
+// unicodePathFromExtra scans extra for an Info-ZIP Unicode Path field:
+// 1-byte version, 4-byte little-endian CRC32 of the original name field,
+// then the UTF-8 name. It is only trusted when the CRC32 matches name.
+func unicodePathFromExtra(extra []byte, name string) (string, bool) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra[0:2])
+		size := binary.LittleEndian.Uint16(extra[2:4])
+		extra = extra[4:]
+		if int(size) > len(extra) {
+			break
+		}
+		field := extra[:size]
+		extra = extra[size:]
+
+		if id != unicodePathExtraID || len(field) < 5 || field[0] != 1 {
+			continue
+		}
+		if crc32.ChecksumIEEE([]byte(name)) != binary.LittleEndian.Uint32(field[1:5]) {
+			continue
+		}
+		return string(field[5:]), true
+	}
+	return "", false
+}
+
+// tarArchive adapts archive/tar, optionally layered on gzip or bzip2, to
+// Archive. closers are closed in the order given, so callers should list the
+// decompressor before the underlying file.
+type tarArchive struct {
+	tr      *tar.Reader
+	closers []io.Closer
+}
+
+func newTarArchive(r io.Reader, closers ...io.Closer) *tarArchive {
+	return &tarArchive{tr: tar.NewReader(r), closers: closers}
+}
+
+func (a *tarArchive) Next() (*Entry, error) {
+	hdr, err := a.tr.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Entry{
+		Name:     decodeName(hdr.Name),
+		Linkname: decodeName(hdr.Linkname),
+		Mode:     hdr.FileInfo().Mode(),
+		ModTime:  hdr.ModTime,
+		IsDir:    hdr.Typeflag == tar.TypeDir,
+		Typeflag: hdr.Typeflag,
+	}, nil
+}
+
+func (a *tarArchive) Open(ent *Entry) (io.ReadCloser, error) {
+	return ioutil.NopCloser(a.tr), nil
+}
+
+// extractLink creates ent as a symlink or hardlink if it is one, reporting
+// whether it handled ent. Only tar entries carry link types; zip entries
+// always fall through to regular file extraction. root is the absolute path
+// of the extraction dir; a link whose target would resolve outside of it is
+// rejected the same way an unsafe entry name is.
+func extractLink(ent *Entry, root string) bool {
+	switch ent.Typeflag {
+	case tar.TypeSymlink, tar.TypeLink:
+	default:
+		return false
+	}
+
+	if !safeLinkTarget(root, ent.Name, ent.Linkname) {
+		if rejectEntry(ent.Name) {
+			return true
+		}
+	}
+
+	if ent.Typeflag == tar.TypeSymlink {
+		log.Printf("symlink entry=%s -> %s", ent.Name, ent.Linkname)
+		if err := os.Symlink(ent.Linkname, ent.Name); err != nil {
+			log.Panicf("symlink %s -> %s err=%v", ent.Name, ent.Linkname, err)
+		}
+		return true
+	}
+
+	log.Printf("hardlink entry=%s -> %s", ent.Name, ent.Linkname)
+	if err := os.Link(ent.Linkname, ent.Name); err != nil {
+		log.Panicf("hardlink %s -> %s err=%v", ent.Name, ent.Linkname, err)
+	}
+	return true
+}
+
+// safeLinkTarget reports whether target, linked from name, resolves inside
+// root once name's parent directory is fully resolved through any existing
+// symlinks, so a previously extracted symlinked parent can't be used to
+// tunnel a later entry outside of root.
+func safeLinkTarget(root, name, target string) bool {
+	if filepath.IsAbs(target) {
+		return false
+	}
+
+	parent, err := filepath.EvalSymlinks(filepath.Dir(filepath.Join(root, name)))
+	if err != nil {
+		return false
+	}
+	dest := filepath.Clean(filepath.Join(parent, target))
+
+	rel, err := filepath.Rel(root, dest)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func (a *tarArchive) Close() error {
+	var err error
+	for _, c := range a.closers {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
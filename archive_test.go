@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSanitizeEntryName(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want string
+		ok   bool
+	}{
+		{"plain", "foo/bar.txt", "foo/bar.txt", true},
+		{"dot-cleaned", "foo/./bar.txt", "foo/bar.txt", true},
+		{"absolute", "/etc/passwd", "", false},
+		{"parent-only", "..", "", false},
+		{"parent-prefix", "../etc/passwd", "", false},
+		{"parent-in-middle", "foo/../../etc/passwd", "", false},
+		{"trailing-parent-cancels-out", "foo/bar/../baz", "foo/baz", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, ok := sanitizeEntryName(c.in)
+			if ok != c.ok {
+				t.Fatalf("sanitizeEntryName(%q) ok = %v, want %v", c.in, ok, c.ok)
+			}
+			if ok && got != c.want {
+				t.Errorf("sanitizeEntryName(%q) = %q, want %q", c.in, got, c.want)
+			}
+		})
+	}
+}
+
+func TestSafeLinkTarget(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0770); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		ent    string
+		target string
+		want   bool
+	}{
+		{"sibling", "sub/link", "file", true},
+		{"into-subdir", "link", "sub/file", true},
+		{"absolute-target", "link", "/etc/passwd", false},
+		{"escapes-via-dotdot", "link", "../../etc/passwd", false},
+		{"escapes-from-subdir", "sub/link", "../../etc/passwd", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := safeLinkTarget(root, c.ent, c.target); got != c.want {
+				t.Errorf("safeLinkTarget(root, %q, %q) = %v, want %v", c.ent, c.target, got, c.want)
+			}
+		})
+	}
+}
+
+// TestSafeLinkTargetSymlinkedParent checks that a symlinked parent directory
+// can't be used to tunnel a later entry outside of root, which is why
+// safeLinkTarget resolves name's parent through EvalSymlinks before joining
+// target.
+func TestSafeLinkTargetSymlinkedParent(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	if safeLinkTarget(root, "escape/link", "file") {
+		t.Error("safeLinkTarget allowed a target resolved through a symlinked parent that escapes root")
+	}
+}
@@ -0,0 +1,62 @@
+//go:build cgo && !nocgo
+
+package zniconv
+
+/*
+#include <iconv.h>
+#include <stdlib.h>
+
+static void myiconv(iconv_t cd, char *inbuf, size_t *inbytesleft, char *outbuf, size_t *outbytesleft) {
+  iconv(cd, &inbuf, inbytesleft, &outbuf, outbytesleft);
+}
+
+*/
+import "C"
+
+import (
+	"unsafe"
+)
+
+// cgoConverter implements Converter on top of the glibc iconv.
+type cgoConverter struct {
+	cd C.iconv_t
+}
+
+func newConverter(opts Options) (Converter, error) {
+	from := getCode(opts.From)
+	defer C.free(unsafe.Pointer(from))
+	to := getCode(opts.To)
+	defer C.free(unsafe.Pointer(to))
+
+	cd, err := C.iconv_open(to, from)
+	if err != nil {
+		return nil, err
+	}
+	return &cgoConverter{cd: cd}, nil
+}
+
+func getCode(s string) *C.char {
+	if s == "" {
+		s = "utf8"
+	}
+	return C.CString(s)
+}
+
+func (c *cgoConverter) Convert(in, out []byte) (inN, outN int, err error) {
+	if len(in) == 0 || len(out) == 0 {
+		return 0, 0, nil
+	}
+	cinleft := C.size_t(len(in))
+	cin := (*C.char)(unsafe.Pointer(&in[0]))
+	coutleft := C.size_t(len(out))
+	cout := (*C.char)(unsafe.Pointer(&out[0]))
+	_, err = C.myiconv(c.cd, cin, &cinleft, cout, &coutleft)
+	inN = len(in) - int(cinleft)
+	outN = len(out) - int(coutleft)
+	return inN, outN, err
+}
+
+func (c *cgoConverter) Close() error {
+	_, err := C.iconv_close(c.cd)
+	return err
+}
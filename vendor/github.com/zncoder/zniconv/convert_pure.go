@@ -0,0 +1,123 @@
+//go:build !cgo || nocgo
+
+package zniconv
+
+import (
+	"bytes"
+	"syscall"
+	"unicode"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/transform"
+)
+
+// textConverter implements Converter on top of golang.org/x/text/encoding,
+// for builds without cgo (e.g. cross-compiled or non-glibc targets). Build
+// with -tags nocgo to force this backend even when cgo is available.
+//
+// Convert runs decode and encode as two explicit stages, through an
+// intermediate utf8 buffer, rather than a single transform.Chain. A Chain
+// can report src bytes as consumed once they are decoded into its internal
+// state, before its encode stage has room in dst to emit them; that breaks
+// the Converter contract Reader and Writer rely on, that inN consumed bytes
+// are always already reflected in outN. Decoding separately also means
+// EILSEQ can be detected on the decoded utf8, not on dst, which is in to's
+// charset, not utf8, whenever to isn't utf-8.
+type textConverter struct {
+	from encoding.Encoding
+	to   encoding.Encoding
+}
+
+func newConverter(opts Options) (Converter, error) {
+	from, err := lookupEncoding(opts.From)
+	if err != nil {
+		return nil, err
+	}
+	to, err := lookupEncoding(opts.To)
+	if err != nil {
+		return nil, err
+	}
+	return &textConverter{from: from, to: to}, nil
+}
+
+func lookupEncoding(name string) (encoding.Encoding, error) {
+	if name == "" {
+		name = "utf8"
+	}
+	return htmlindex.Get(name)
+}
+
+// Convert always passes atEOF=false to the underlying Transformers, so an
+// incomplete trailing sequence comes back as transform.ErrShortSrc/EINVAL
+// rather than being silently replaced, matching how iconv(3) always needs
+// the caller to decide whether EINVAL is real based on whether more input
+// is coming.
+//
+// Unlike glibc iconv, x/text decoders do not error on an invalid byte
+// sequence; they substitute the sequence with utf8.RuneError and carry on.
+// Convert approximates iconv's EILSEQ by checking the decoded utf8 for that
+// replacement rune before it ever reaches the encode stage.
+func (c *textConverter) Convert(in, out []byte) (inN, outN int, err error) {
+	if len(in) == 0 || len(out) == 0 {
+		return 0, 0, nil
+	}
+
+	// Decoded runes never take more than 4 utf8 bytes each, and decoding
+	// can produce at most len(in) runes, so 4*len(in) always has room for
+	// the complete decode of in.
+	decBuf := make([]byte, 4*len(in))
+	nDec, nSrc, derr := c.from.NewDecoder().Transform(decBuf, in, false)
+	incomplete := false
+	switch derr {
+	case nil:
+	case transform.ErrShortSrc:
+		if nSrc == 0 {
+			// in doesn't hold even one complete sequence; report no
+			// progress so the caller retries with more data once it has
+			// some, or fails at real EOF.
+			return 0, 0, syscall.EINVAL
+		}
+		// nSrc bytes of in decoded cleanly before the incomplete trailing
+		// sequence; encode that valid prefix below, but still report
+		// EINVAL for the dangling tail once it has been.
+		incomplete = true
+	default:
+		return 0, 0, syscall.EILSEQ
+	}
+
+	decoded := decBuf[:nDec]
+	if bytes.ContainsRune(decoded, unicode.ReplacementChar) {
+		return 0, 0, syscall.EILSEQ
+	}
+
+	nEnc, nEncSrc, eerr := c.to.NewEncoder().Transform(out, decoded, false)
+	switch {
+	case eerr == nil:
+		// All of decoded fit: the nSrc bytes of in that produced it are
+		// now fully reflected in the nEnc bytes written to out.
+		if incomplete {
+			return nSrc, nEnc, syscall.EINVAL
+		}
+		return nSrc, nEnc, nil
+
+	case eerr == transform.ErrShortDst && nEnc > 0:
+		// Only a prefix of decoded fit in out. Re-decode in, capping the
+		// intermediate buffer to exactly that many bytes, so nSrcFit
+		// reports precisely how many bytes of in produced the prefix that
+		// made it into out, keeping inN and outN in lockstep.
+		_, nSrcFit, _ := c.from.NewDecoder().Transform(make([]byte, nEncSrc), in, false)
+		return nSrcFit, nEnc, syscall.E2BIG
+
+	case eerr == transform.ErrShortDst:
+		// out can't hold even the first decoded rune.
+		return 0, 0, syscall.E2BIG
+
+	default:
+		return 0, 0, syscall.EILSEQ
+	}
+}
+
+func (c *textConverter) Close() error {
+	return nil
+}
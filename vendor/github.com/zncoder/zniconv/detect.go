@@ -0,0 +1,170 @@
+package zniconv
+
+import (
+	"bytes"
+	"io"
+	"unicode"
+	"unicode/utf8"
+)
+
+// detectCandidates are the charsets Detect chooses among, in tie-break
+// order: ties are broken toward whichever of these comes first. Besides
+// utf-8, they are ordered by how constrained each charset's valid lead/trail
+// byte-pair space is, narrowest first: euc-kr's and shift_jis's valid pairs
+// are a small fraction of gb18030's, so a sample that decodes cleanly under
+// both euc-kr and gb18030 is much stronger evidence for euc-kr, which has far
+// fewer byte-pairs available to decode cleanly by coincidence. gb18030 comes
+// last because its lead/trail ranges are close to a superset of the others',
+// so it decodes almost any well-formed DBCS sample without error; it still
+// serves as the fallback default when every candidate ties exactly.
+var detectCandidates = []string{"utf-8", "euc-kr", "shift_jis", "big5", "gb18030"}
+
+const detectSampleSize = 4096
+
+// Detect inspects a bounded prefix of r and guesses which of the
+// detectCandidates charsets it is encoded in. It returns the detected
+// charset name and a Reader that reconstructs r: the sampled prefix followed
+// by whatever is left unread in r, so no bytes are lost.
+//
+// Each candidate is scored over the sample by validating that candidate's
+// lead/trail byte rules, then actually decoding the sample as that charset
+// and counting how many resulting runes fall in the charset's expected
+// Unicode block (Han for gb18030/big5, kana/Han for shift_jis, Hangul for
+// euc-kr). Decoding also rejects candidates that merely happen to share
+// lead/trail byte ranges with the real charset: gb18030, big5, shift_jis and
+// euc-kr byte ranges overlap heavily, but their lead/trail byte pairs map to
+// different code points, so decoding a sample under the wrong one of these
+// usually produces invalid sequences or runes outside the expected block.
+// One byte that cannot start or continue a sequence in a candidate charset
+// disqualifies it outright rather than merely costing it points, since a
+// structurally invalid byte means the sample cannot be that charset. The
+// highest-scoring valid candidate wins; ties are broken following
+// detectCandidates' order, so utf-8 wins first and gb18030 last.
+func Detect(r io.Reader) (string, io.Reader, error) {
+	buf := make([]byte, detectSampleSize)
+	n, err := io.ReadFull(r, buf)
+	switch err {
+	case nil, io.ErrUnexpectedEOF, io.EOF:
+	default:
+		return "", nil, err
+	}
+	sample := buf[:n]
+	rest := io.MultiReader(bytes.NewReader(sample), r)
+
+	name := detectCandidates[0]
+	bestScore := -1
+	for _, cand := range detectCandidates {
+		score, ok := scoreCharset(cand, sample)
+		if ok && score > bestScore {
+			name, bestScore = cand, score
+		}
+	}
+	return name, rest, nil
+}
+
+func scoreCharset(name string, b []byte) (score int, ok bool) {
+	switch name {
+	case "utf-8":
+		return scoreUTF8(b)
+	case "gb18030":
+		return scoreDBCS(name, b, gb18030Lead, gb18030Trail, isHanRune)
+	case "big5":
+		return scoreDBCS(name, b, big5Lead, big5Trail, isHanRune)
+	case "shift_jis":
+		return scoreDBCS(name, b, sjisLead, sjisTrail, isJapaneseRune)
+	case "euc-kr":
+		return scoreDBCS(name, b, euckrLead, euckrTrail, isHangulRune)
+	}
+	return 0, false
+}
+
+func isHanRune(r rune) bool    { return unicode.Is(unicode.Han, r) }
+func isHangulRune(r rune) bool { return unicode.Is(unicode.Hangul, r) }
+
+func isJapaneseRune(r rune) bool {
+	return unicode.In(r, unicode.Hiragana, unicode.Katakana, unicode.Han)
+}
+
+// scoreUTF8 counts multibyte runes in b, used as a proxy for runes in a CJK
+// block: a utf-8 sample that is mostly multibyte CJK text scores high, one
+// that is plain ASCII scores 0 but is still valid.
+func scoreUTF8(b []byte) (int, bool) {
+	score := 0
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		if r == utf8.RuneError && size <= 1 {
+			if len(b) < utf8.UTFMax {
+				// could be a valid sequence truncated by the sample boundary
+				break
+			}
+			return 0, false
+		}
+		if size > 1 {
+			score++
+		}
+		b = b[size:]
+	}
+	return score, true
+}
+
+// scoreDBCS scores a double-byte charset named name and described by
+// isLead/isTrail: bytes below 0x80 pass through as ASCII, and a lead byte
+// must be immediately followed by a valid trail byte. A byte that cannot
+// start or continue a sequence disqualifies the candidate outright.
+//
+// Byte-range validity alone cannot tell gb18030, big5, shift_jis and euc-kr
+// apart: their lead/trail ranges overlap heavily. So once the sample passes
+// the structural check, it is actually decoded as name and the decoded runes
+// are counted against inBlock, the charset's expected Unicode block. Wrong
+// candidates usually fail to decode at all, since lead/trail byte pairs that
+// are structurally valid in two overlapping charsets rarely map to an
+// assigned code point in both; Convert reports that as an error, which
+// disqualifies the candidate the same as a structural mismatch.
+func scoreDBCS(name string, b []byte, isLead, isTrail func(byte) bool, inBlock func(rune) bool) (int, bool) {
+	end := len(b)
+	for i := 0; i < len(b); {
+		c := b[i]
+		switch {
+		case c < 0x80:
+			i++
+		case isLead(c):
+			if i+1 >= len(b) {
+				// sequence cut off by the sample boundary; drop it before decoding
+				end = i
+				i++
+				continue
+			}
+			if !isTrail(b[i+1]) {
+				return 0, false
+			}
+			i += 2
+		default:
+			return 0, false
+		}
+	}
+
+	decoded, err := Convert(name, "utf-8", b[:end])
+	if err != nil {
+		return 0, false
+	}
+
+	score := 0
+	for _, r := range string(decoded) {
+		if inBlock(r) {
+			score++
+		}
+	}
+	return score, true
+}
+
+func gb18030Lead(c byte) bool  { return c >= 0x81 && c <= 0xfe }
+func gb18030Trail(c byte) bool { return c >= 0x40 && c <= 0xfe && c != 0x7f }
+
+func big5Lead(c byte) bool  { return c >= 0x81 && c <= 0xfe }
+func big5Trail(c byte) bool { return (c >= 0x40 && c <= 0x7e) || (c >= 0xa1 && c <= 0xfe) }
+
+func sjisLead(c byte) bool  { return (c >= 0x81 && c <= 0x9f) || (c >= 0xe0 && c <= 0xfc) }
+func sjisTrail(c byte) bool { return c >= 0x40 && c <= 0xfc && c != 0x7f }
+
+func euckrLead(c byte) bool  { return c >= 0xa1 && c <= 0xfe }
+func euckrTrail(c byte) bool { return c >= 0xa1 && c <= 0xfe }
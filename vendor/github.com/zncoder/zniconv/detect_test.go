@@ -0,0 +1,80 @@
+package zniconv
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// text is repeated so the sample is long enough that the wrong charset's
+// occasional coincidental byte-pair hits don't swamp a short sample.
+func TestDetect(t *testing.T) {
+	cases := []struct {
+		name string
+		text string
+	}{
+		{"utf-8", strings.Repeat("hello world, this is plain ascii text. ", 5)},
+		{"gb18030", strings.Repeat("中华人民共和国成立七十五周年纪念大会在北京隆重举行", 5)},
+		{"big5", strings.Repeat("臺灣繁體中文測試文件今天天氣非常好適合出去散步", 5)},
+		{"shift_jis", strings.Repeat("こんにちは日本語のテストファイルです今日は天気です", 5)},
+		{"euc-kr", strings.Repeat("안녕하세요한국어테스트파일입니다오늘은날씨가좋습니다", 5)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			enc := []byte(c.text)
+			if c.name != "utf-8" {
+				var err error
+				enc, err = Convert("utf-8", c.name, []byte(c.text))
+				if err != nil {
+					t.Fatalf("encode as %s: %v", c.name, err)
+				}
+			}
+
+			got, rest, err := Detect(bytes.NewReader(enc))
+			if err != nil {
+				t.Fatalf("Detect: %v", err)
+			}
+			if got != c.name {
+				t.Errorf("Detect(%s text) = %s, want %s", c.name, got, c.name)
+			}
+
+			all, err := io.ReadAll(rest)
+			if err != nil {
+				t.Fatalf("read rest: %v", err)
+			}
+			if !bytes.Equal(all, enc) {
+				t.Errorf("rest reconstructed %d bytes, want the original %d bytes back unchanged", len(all), len(enc))
+			}
+		})
+	}
+}
+
+// TestDetectShortSample checks that a sample much smaller than
+// detectSampleSize still reconstructs losslessly and picks the right
+// charset, since this is the boundary where io.ReadFull returns
+// io.ErrUnexpectedEOF. The text needs enough distinct characters that it
+// isn't also a tied, equally-valid sample under a more specific candidate
+// charset (e.g. a 2-character sample can tie with big5).
+func TestDetectShortSample(t *testing.T) {
+	enc, err := Convert("utf-8", "gb18030", []byte("中华人民共和国成立纪念大会"))
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	name, rest, err := Detect(bytes.NewReader(enc))
+	if err != nil {
+		t.Fatalf("Detect: %v", err)
+	}
+	if name != "gb18030" {
+		t.Errorf("Detect(short gb18030 text) = %s, want gb18030", name)
+	}
+
+	all, err := io.ReadAll(rest)
+	if err != nil {
+		t.Fatalf("read rest: %v", err)
+	}
+	if !bytes.Equal(all, enc) {
+		t.Errorf("rest reconstructed %d bytes, want the original %d bytes back unchanged", len(all), len(enc))
+	}
+}
@@ -0,0 +1,60 @@
+package zniconv
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+// chunkedReader hands back a fixed n bytes per Read, regardless of multibyte
+// sequence boundaries in the underlying data, the way many real io.Readers
+// (network conns, pipes) do.
+type chunkedReader struct {
+	data []byte
+	n    int
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	k := r.n
+	if k > len(p) {
+		k = len(p)
+	}
+	if k > len(r.data) {
+		k = len(r.data)
+	}
+	n := copy(p[:k], r.data[:k])
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// TestReaderChunkedMultibyteBoundary feeds a Reader through a source that
+// splits the input at byte counts unaligned with utf-8 rune boundaries, so
+// Convert regularly sees an in buffer decoding to a valid prefix followed by
+// an incomplete trailing sequence. Convert must still report the prefix's
+// length as consumed; reporting 0 there would leave r.left unchanged forever
+// and hang ReadAll.
+func TestReaderChunkedMultibyteBoundary(t *testing.T) {
+	text := strings.Repeat("中", 20)
+
+	src := &chunkedReader{data: []byte(text), n: 25}
+	r, err := NewReader(Options{From: "utf-8", To: "gb18030", BufSize: 64}, src)
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+
+	got, err := r.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+
+	want, err := Convert("utf-8", "gb18030", []byte(text))
+	if err != nil {
+		t.Fatalf("Convert reference: %v", err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("ReadAll = %x, want %x", got, want)
+	}
+}
@@ -0,0 +1,170 @@
+package zniconv
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriterRoundTrip(t *testing.T) {
+	const text = "中华人民共和国成立七十五周年纪念"
+
+	var buf bytes.Buffer
+	w, err := NewWriter(Options{From: "utf-8", To: "gb18030"}, &buf)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	if _, err := w.Write([]byte(text)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	want, err := Convert("utf-8", "gb18030", []byte(text))
+	if err != nil {
+		t.Fatalf("Convert reference: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("Writer output = %x, want %x", buf.Bytes(), want)
+	}
+
+	back, err := Convert("gb18030", "utf-8", buf.Bytes())
+	if err != nil {
+		t.Fatalf("Convert back: %v", err)
+	}
+	if string(back) != text {
+		t.Errorf("round-tripped text = %q, want %q", back, text)
+	}
+}
+
+// TestWriterE2BIGGrowth forces a 1-byte internal buffer, far too small for
+// even one multibyte gb18030 sequence, so every Write must grow w.buf in the
+// syscall.E2BIG loop before it can make progress.
+func TestWriterE2BIGGrowth(t *testing.T) {
+	const text = "中华人民共和国"
+
+	var buf bytes.Buffer
+	w, err := NewWriter(Options{From: "utf-8", To: "gb18030", BufSize: 1}, &buf)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	if _, err := w.Write([]byte(text)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	want, err := Convert("utf-8", "gb18030", []byte(text))
+	if err != nil {
+		t.Fatalf("Convert reference: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("Writer output with 1-byte BufSize = %x, want %x", buf.Bytes(), want)
+	}
+}
+
+// TestWriterIncompleteTail checks the EINVAL tail-retention contract: a
+// Write that ends mid multibyte-sequence must still report consuming all of
+// p, and must hold the dangling bytes in left until a later Write completes
+// the sequence, rather than erroring or dropping them.
+func TestWriterIncompleteTail(t *testing.T) {
+	const text = "中华人民共和国"
+	full := []byte(text)
+
+	// "中" is 3 bytes in utf-8; split the input so the first Write ends
+	// after only 2 of those 3 bytes.
+	split := 2
+
+	var buf bytes.Buffer
+	w, err := NewWriter(Options{From: "utf-8", To: "gb18030"}, &buf)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+
+	n, err := w.Write(full[:split])
+	if err != nil {
+		t.Fatalf("Write(first part): %v", err)
+	}
+	if n != split {
+		t.Errorf("Write(first part) consumed %d bytes, want %d (never short)", n, split)
+	}
+
+	if err := w.Flush(); err == nil {
+		t.Error("Flush with a dangling incomplete sequence should error, got nil")
+	}
+
+	n, err = w.Write(full[split:])
+	if err != nil {
+		t.Fatalf("Write(rest): %v", err)
+	}
+	if n != len(full)-split {
+		t.Errorf("Write(rest) consumed %d bytes, want %d", n, len(full)-split)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close after completing the sequence: %v", err)
+	}
+
+	want, err := Convert("utf-8", "gb18030", full)
+	if err != nil {
+		t.Fatalf("Convert reference: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("output after split write = %x, want %x", buf.Bytes(), want)
+	}
+}
+
+// TestWriterDanglingTailNeverCompleted checks that Close surfaces the Flush
+// error when an incomplete sequence is never completed.
+func TestWriterDanglingTailNeverCompleted(t *testing.T) {
+	const text = "中"
+	full := []byte(text)
+
+	var buf bytes.Buffer
+	w, err := NewWriter(Options{From: "utf-8", To: "gb18030"}, &buf)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	if _, err := w.Write(full[:1]); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err == nil {
+		t.Error("Close with a never-completed incomplete sequence should error, got nil")
+	}
+}
+
+// TestWriterManyLines exercises the Writer the way the package doc promises
+// it will be used: io.Copy from a charset-converting Reader into a Writer
+// converting to the same target charset, one chunk at a time.
+func TestWriterManyLines(t *testing.T) {
+	lines := []string{
+		"中华人民共和国",
+		"成立七十五周年",
+		"纪念大会在北京隆重举行",
+	}
+	text := strings.Join(lines, "\n")
+
+	var buf bytes.Buffer
+	w, err := NewWriter(Options{From: "utf-8", To: "gb18030"}, &buf)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	for _, line := range lines {
+		if _, err := w.Write([]byte(line + "\n")); err != nil {
+			t.Fatalf("Write(%q): %v", line, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	want, err := Convert("utf-8", "gb18030", []byte(text+"\n"))
+	if err != nil {
+		t.Fatalf("Convert reference: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("Writer output = %x, want %x", buf.Bytes(), want)
+	}
+}
@@ -1,32 +1,18 @@
-// Package zniconv provides a Reader to convert the charset of data.
-// It wraps an io.Reader, and converts the data read from the io.Reader to the target charset.
-// The actual conversion is done by the glibc iconv.
+// Package zniconv provides a Reader and a Writer to convert the charset of data.
+// Reader wraps an io.Reader, and converts the data read from the io.Reader to the target charset.
+// Writer wraps an io.Writer, and converts data written to it before passing it on to the io.Writer.
 //
-// No Writer is provided, for two reasons,
-// 1. conversion from one charset to another can be achieved with Reader
-// 2. io.Writer requires that a short write return an error,
-//    but short write does not play well with io.Copy.
-//    Short write is legitimate when multibyte sequences are involved.
+// The actual conversion is done by a Converter. Builds with cgo use the glibc
+// iconv; builds without cgo, or built with -tags nocgo, fall back to a
+// pure-Go backend on top of golang.org/x/text/encoding.
 package zniconv
 
-/*
-#include <iconv.h>
-#include <stdlib.h>
-
-static void myiconv(iconv_t cd, char *inbuf, size_t *inbytesleft, char *outbuf, size_t *outbytesleft) {
-  iconv(cd, &inbuf, inbytesleft, &outbuf, outbytesleft);
-}
-
-*/
-import "C"
-
 import (
 	"bytes"
 	"fmt"
 	"io"
 	"log"
 	"syscall"
-	"unsafe"
 )
 
 //go:generate stringer -type=ErrCode
@@ -57,13 +43,6 @@ type Options struct {
 	BufSize int    // internal buffer size
 }
 
-func getCode(s string) *C.char {
-	if s == "" {
-		s = "utf8"
-	}
-	return C.CString(s)
-}
-
 func getBufSize(n int) int {
 	if n == 0 {
 		n = defaultBufSize
@@ -71,8 +50,21 @@ func getBufSize(n int) int {
 	return n
 }
 
+// Converter performs one charset conversion step, converting as much of in
+// into out as fits. Its error contract mirrors errno from iconv(3): a nil
+// error means all of in was converted, syscall.E2BIG means out is too small
+// for the next sequence, syscall.EILSEQ means in holds an invalid sequence,
+// and syscall.EINVAL means in ends with an incomplete sequence. newConverter
+// picks the backend, and is implemented per build tag in convert_cgo.go and
+// convert_pure.go.
+type Converter interface {
+	Convert(in, out []byte) (inN, outN int, err error)
+	Close() error
+}
+
 type Reader struct {
-	c       C.iconv_t
+	opts    Options
+	c       Converter
 	r       io.Reader
 	buf     []byte
 	left    []byte
@@ -85,17 +77,13 @@ type Reader struct {
 // The charset of data in r is opts.From, and the charset of the
 // output of this Reader is opts.To.
 func NewReader(opts Options, r io.Reader) (*Reader, error) {
-	from := getCode(opts.From)
-	defer C.free(unsafe.Pointer(from))
-	to := getCode(opts.To)
-	defer C.free(unsafe.Pointer(to))
-
-	c, err := C.iconv_open(to, from)
+	c, err := newConverter(opts)
 	if err != nil {
 		return nil, err
 	}
 	sz := getBufSize(opts.BufSize)
 	return &Reader{
+		opts:    opts,
 		c:       c,
 		r:       r,
 		buf:     make([]byte, sz),
@@ -114,7 +102,7 @@ func (r *Reader) Read(b []byte) (int, error) {
 			break
 		}
 
-		i, o, err := iconv(r.c, r.left, b[off:])
+		i, o, err := r.c.Convert(r.left, b[off:])
 		r.goff += int64(i)
 		r.left = r.left[i:]
 		off += o
@@ -138,17 +126,22 @@ func (r *Reader) Read(b []byte) (int, error) {
 			}
 
 		default:
-			r.fail(Err{Code: Eunknown, Reason: fmt.Sprintf("unknown iconv err=%v at offset=%d", err, r.goff)})
+			r.fail(Err{Code: Eunknown, Reason: fmt.Sprintf("unknown convert err=%v at offset=%d", err, r.goff)})
 		}
 	}
 	return off, r.err
 }
 
+// Reset lets r be reused to convert rr, recreating the underlying Converter
+// so no state (e.g. shift-state encodings) leaks across streams.
 func (r *Reader) Reset(rr io.Reader) {
-	if _, err := C.iconv(r.c, nil, nil, nil, nil); err != nil {
-		r.fail(Err{Code: Eunknown, Reason: fmt.Sprintf("unknown iconv err=%v at reset", err)})
+	r.c.Close()
+	c, err := newConverter(r.opts)
+	if err != nil {
+		r.fail(Err{Code: Eunknown, Reason: fmt.Sprintf("recreate converter at reset err=%v", err)})
 		return
 	}
+	r.c = c
 
 	r.r = rr
 	r.left = nil
@@ -174,17 +167,6 @@ func capped(b []byte) []byte {
 	return b[:10]
 }
 
-func iconv(cd C.iconv_t, in, out []byte) (inOff, outOff int, err error) {
-	cinleft := C.size_t(len(in))
-	cin := (*C.char)(unsafe.Pointer(&in[0]))
-	coutleft := C.size_t(len(out))
-	cout := (*C.char)(unsafe.Pointer(&out[0]))
-	_, err = C.myiconv(cd, cin, &cinleft, cout, &coutleft)
-	inOff = len(in) - int(cinleft)
-	outOff = len(out) - int(coutleft)
-	return inOff, outOff, err
-}
-
 func (r *Reader) refill() {
 	if r.err != nil {
 		return
@@ -214,8 +196,93 @@ func (r *Reader) fail(err error) {
 }
 
 func (r *Reader) Close() error {
-	_, err := C.iconv_close(r.c)
-	return err
+	return r.c.Close()
+}
+
+// Writer converts the charset of data written to it before passing it on to
+// the wrapped io.Writer.
+type Writer struct {
+	c    Converter
+	w    io.Writer
+	left []byte // an incomplete multibyte sequence left over from the previous Write
+	buf  []byte
+}
+
+// NewWriter creates a Writer that converts the charset of data written to it
+// from opts.From to opts.To, and writes the result to w.
+func NewWriter(opts Options, w io.Writer) (*Writer, error) {
+	c, err := newConverter(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{
+		c:   c,
+		w:   w,
+		buf: make([]byte, getBufSize(opts.BufSize)),
+	}, nil
+}
+
+// Write converts p and writes the result to the wrapped io.Writer. It always
+// consumes all of p, even when p ends with an incomplete multibyte
+// sequence; the incomplete tail is held in left and prepended to the next
+// Write. Call Flush or Close to detect a dangling incomplete sequence at
+// end of input.
+func (w *Writer) Write(p []byte) (int, error) {
+	in := make([]byte, len(w.left)+len(p))
+	copy(in, w.left)
+	copy(in[len(w.left):], p)
+	w.left = nil
+
+	for len(in) > 0 {
+		i, o, err := w.c.Convert(in, w.buf)
+		if o > 0 {
+			if _, werr := w.w.Write(w.buf[:o]); werr != nil {
+				return len(p), werr
+			}
+		}
+		in = in[i:]
+
+		switch err {
+		case nil:
+
+		case syscall.E2BIG:
+			if i == 0 {
+				// not even one multibyte sequence fits in buf, grow it.
+				w.buf = make([]byte, len(w.buf)*2)
+			}
+
+		case syscall.EILSEQ:
+			return len(p), Err{Code: Eilseq, Reason: fmt.Sprintf("invalid multibyte seq=%x", capped(in))}
+
+		case syscall.EINVAL:
+			// incomplete multibyte sequence at the tail of p, it may be
+			// completed by the next Write.
+			w.left = append([]byte(nil), in...)
+			return len(p), nil
+
+		default:
+			return len(p), Err{Code: Eunknown, Reason: fmt.Sprintf("unknown convert err=%v", err)}
+		}
+	}
+	return len(p), nil
+}
+
+// Flush reports an error if Write left an incomplete multibyte sequence
+// unconverted.
+func (w *Writer) Flush() error {
+	if len(w.left) > 0 {
+		return Err{Code: Einval, Reason: fmt.Sprintf("incomplete multibyte seq=%x at flush", capped(w.left))}
+	}
+	return nil
+}
+
+// Close flushes w and releases the underlying Converter.
+func (w *Writer) Close() error {
+	ferr := w.Flush()
+	if err := w.c.Close(); err != nil {
+		return err
+	}
+	return ferr
 }
 
 func Convert(from, to string, b []byte) ([]byte, error) {
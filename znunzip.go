@@ -1,14 +1,18 @@
 package main
 
 import (
-	"archive/zip"
+	"bytes"
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 
+	"github.com/zncoder/zniconv"
 	"golang.org/x/text/encoding"
 	"golang.org/x/text/encoding/htmlindex"
 )
@@ -16,7 +20,9 @@ import (
 var (
 	extract     = flag.Bool("x", false, "extract")
 	keepPartial = flag.Bool("k", false, "keep partial result when unzip fails")
-	charset     = flag.String("c", "gb18030", "charset used in the zip file")
+	charset     = flag.String("c", "gb18030", "charset used in the archive, or \"auto\" to detect it from entry names")
+	jobs        = flag.Int("j", 1, "number of parallel workers to use when extracting (zip archives only)")
+	skipUnsafe  = flag.Bool("skip-unsafe", false, "skip entries that would escape the extraction dir instead of aborting the archive")
 )
 
 var conv *encoding.Decoder
@@ -24,28 +30,90 @@ var conv *encoding.Decoder
 func main() {
 	flag.Parse()
 
-	cs, err := htmlindex.Get(*charset)
+	if *charset != "auto" {
+		setConv(*charset)
+	}
+
+	for _, af := range flag.Args() {
+		unarchive(af)
+	}
+}
+
+// setConv makes conv decode from name to utf8.
+func setConv(name string) {
+	cs, err := htmlindex.Get(name)
 	if err != nil {
-		log.Fatalf("get encoding of charset=%s err=%v", *charset, err)
+		log.Fatalf("get encoding of charset=%s err=%v", name, err)
 	}
 	conv = cs.NewDecoder()
+}
 
-	for _, zf := range flag.Args() {
-		unzip(zf)
+// decodeName converts s from *charset to utf8, falling back to s if s is not
+// valid in that charset.
+func decodeName(s string) string {
+	if collectRaw != nil {
+		collectRaw(s)
 	}
+	fn, err := conv.String(s)
+	if err != nil {
+		return s
+	}
+	return fn
 }
 
-func unzip(zf string) {
-	r, err := zip.OpenReader(zf)
+// collectRaw, when non-nil, receives every entry name as Next/Entries reads
+// it, before any charset decoding happens. detectArchiveCharset uses this to
+// sample an archive's raw entry names.
+var collectRaw func(raw string)
+
+// detectArchiveCharset makes one read-only pass over af's entries, feeding
+// their raw (pre-decode) names to zniconv.Detect, so auto mode picks one
+// consistent charset for the whole archive instead of guessing per entry.
+func detectArchiveCharset(af string) string {
+	setConv("gb18030") // placeholder so decodeName has something to call; its result here is discarded
+
+	a, err := openArchive(af)
 	if err != nil {
-		log.Panicf("open zip reader of file=%s err=%v", zf, err)
+		log.Panicf("open archive=%s for charset detection err=%v", af, err)
+	}
+	defer a.Close()
+
+	var raw bytes.Buffer
+	collectRaw = func(s string) { raw.WriteString(s) }
+	defer func() { collectRaw = nil }()
+
+	for {
+		_, err := a.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Panicf("read next entry of archive=%s err=%v", af, err)
+		}
+	}
+
+	name, _, err := zniconv.Detect(bytes.NewReader(raw.Bytes()))
+	if err != nil {
+		log.Panicf("detect charset of archive=%s err=%v", af, err)
+	}
+	log.Printf("detected charset=%s for archive=%s", name, af)
+	return name
+}
 
+func unarchive(af string) {
+	if *charset == "auto" {
+		setConv(detectArchiveCharset(af))
 	}
-	defer r.Close()
 
-	var tempdir string
+	a, err := openArchive(af)
+	if err != nil {
+		log.Panicf("open archive=%s err=%v", af, err)
+	}
+	defer a.Close()
+
+	var tempdir, root string
 	if *extract {
-		tempdir, err = ioutil.TempDir(".", zf)
+		tempdir, err = ioutil.TempDir(".", filepath.Base(af))
 		if err != nil {
 			log.Panicf("create tempdir err=%v", err)
 		}
@@ -63,79 +131,223 @@ func unzip(zf string) {
 				log.Panicf("remove tempdir=%s err=%v", tempdir, err)
 			}
 		}()
+
+		root, err = os.Getwd()
+		if err != nil {
+			log.Panicf("getwd err=%v", err)
+		}
 	}
 
-	for _, f := range r.File {
-		unzipOne(f)
+	if pa, ok := a.(ParallelArchive); ok && *extract && *jobs > 1 {
+		extractParallel(pa, *jobs)
+	} else {
+		extractSerial(a, root)
 	}
 
 	if *extract {
-		d, err := os.Open(".")
-		if err != nil {
-			log.Panicf("open cwd err=%v", err)
+		stageOut()
+	}
+}
+
+func extractSerial(a Archive, root string) {
+	for {
+		ent, err := a.Next()
+		if err == io.EOF {
+			break
 		}
-		names, err := d.Readdirnames(0)
 		if err != nil {
-			log.Panicf("readdirnames err=%v", err)
+			log.Panicf("read next entry err=%v", err)
 		}
-		for _, name := range names {
-			newname := "../" + name
-			if _, err = os.Lstat(newname); err == nil {
-				log.Panicf("would overwrite file=%s", name)
+		extractEntry(a, ent, root)
+	}
+}
+
+// sanitizeEntryName rejects absolute paths and paths that climb above the
+// extraction root via "..", which is how a malicious archive (zip-slip)
+// escapes the staging directory.
+func sanitizeEntryName(name string) (string, bool) {
+	if filepath.IsAbs(name) {
+		return "", false
+	}
+	clean := filepath.Clean(name)
+	if clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return clean, true
+}
+
+// rejectEntry reports an unsafe entry, aborting the whole archive unless
+// *skipUnsafe asks to skip just this entry.
+func rejectEntry(name string) (skip bool) {
+	if *skipUnsafe {
+		log.Printf("skip unsafe entry=%s", name)
+		return true
+	}
+	log.Panicf("unsafe entry path=%s", name)
+	return false
+}
+
+// extractParallel extracts ents using n worker goroutines, each opening its
+// own reader from a. Directories are created up front, serialized, so
+// workers never race to MkdirAll the same parent. Per-file log lines are
+// streamed through a single goroutine so logging stays deterministic despite
+// the workers finishing in arbitrary order.
+func extractParallel(a ParallelArchive, n int) {
+	rawEnts, err := a.Entries()
+	if err != nil {
+		log.Panicf("list entries err=%v", err)
+	}
+
+	var ents []*Entry
+	for _, ent := range rawEnts {
+		fn, ok := sanitizeEntryName(ent.Name)
+		if !ok {
+			if rejectEntry(ent.Name) {
+				continue
+			}
+		}
+		ent.Name = fn
+		ents = append(ents, ent)
+	}
+
+	for _, ent := range ents {
+		if ent.IsDir {
+			log.Printf("mkdir entry=%s", ent.Name)
+			if err := os.MkdirAll(ent.Name, ent.Mode|0770); err != nil {
+				log.Panicf("mkdirall d=%s err=%v", ent.Name, err)
 			}
+			continue
+		}
+		if d := filepath.Dir(ent.Name); d != "." {
+			if err := os.MkdirAll(d, 0770); err != nil {
+				log.Panicf("mkdirall d=%s err=%v", d, err)
+			}
+		}
+	}
+
+	logc := make(chan string)
+	logdone := make(chan struct{})
+	go func() {
+		defer close(logdone)
+		for msg := range logc {
+			log.Println(msg)
 		}
-		for _, name := range names {
-			newname := "../" + name
-			if err = os.Rename(name, newname); err != nil {
-				log.Panicf("rename %s to %s err=%v", name, newname, err)
+	}()
+	logf := func(format string, args ...interface{}) {
+		logc <- fmt.Sprintf(format, args...)
+	}
+
+	entc := make(chan *Entry)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ent := range entc {
+				extractFile(a, ent, logf)
 			}
+		}()
+	}
+
+	for _, ent := range ents {
+		if !ent.IsDir {
+			entc <- ent
 		}
 	}
+	close(entc)
+	wg.Wait()
+
+	close(logc)
+	<-logdone
 }
 
-func unzipOne(zf *zip.File) {
-	fn, err := conv.String(zf.Name)
+// stageOut moves everything extracted into the tempdir up into the
+// directory unarchive was invoked from.
+func stageOut() {
+	d, err := os.Open(".")
+	if err != nil {
+		log.Panicf("open cwd err=%v", err)
+	}
+	names, err := d.Readdirnames(0)
 	if err != nil {
-		fn = zf.Name
+		log.Panicf("readdirnames err=%v", err)
 	}
+	for _, name := range names {
+		newname := "../" + name
+		if _, err = os.Lstat(newname); err == nil {
+			log.Panicf("would overwrite file=%s", name)
+		}
+	}
+	for _, name := range names {
+		newname := "../" + name
+		if err = os.Rename(name, newname); err != nil {
+			log.Panicf("rename %s to %s err=%v", name, newname, err)
+		}
+	}
+}
 
+func extractEntry(a Archive, ent *Entry, root string) {
 	if !*extract {
-		log.Println(fn)
+		log.Println(ent.Name)
 		return
 	}
 
-	if d, f := filepath.Split(fn); d != "" {
-		log.Printf("mkdir entry=%s", d)
-		if err := os.MkdirAll(d, zf.Mode()|0770); err != nil {
+	fn, ok := sanitizeEntryName(ent.Name)
+	if !ok {
+		if rejectEntry(ent.Name) {
+			return
+		}
+	}
+	ent.Name = fn
+
+	if d := filepath.Dir(fn); d != "." {
+		if err := os.MkdirAll(d, 0770); err != nil {
 			log.Panicf("mkdirall d=%s err=%v", d, err)
 		}
-		if f == "" {
-			return
+	}
+
+	if ent.IsDir {
+		log.Printf("mkdir entry=%s", fn)
+		if err := os.MkdirAll(fn, ent.Mode|0770); err != nil {
+			log.Panicf("mkdirall d=%s err=%v", fn, err)
 		}
+		return
+	}
+
+	if extractLink(ent, root) {
+		return
 	}
 
-	log.Printf("extracting file=%s", fn)
-	in, err := zf.Open()
+	extractFile(a, ent, log.Printf)
+}
+
+// extractFile extracts the regular file content of ent, assuming its parent
+// directory already exists. logf receives progress messages, letting
+// extractParallel serialize them through a single goroutine.
+func extractFile(a Archive, ent *Entry, logf func(string, ...interface{})) {
+	fn := ent.Name
+
+	logf("extracting file=%s", fn)
+	in, err := a.Open(ent)
 	if err != nil {
-		log.Panicf("open zip file=%s err=%v", fn, err)
+		log.Panicf("open entry=%s err=%v", fn, err)
 	}
 	out, err := os.Create(fn)
 	if err != nil {
-		log.Panicf("create zip file=%s err=%v", fn, err)
+		log.Panicf("create file=%s err=%v", fn, err)
 	}
 	if _, err = io.Copy(out, in); err != nil {
-		log.Panicf("extract zip file=%s err=%v", fn, err)
-
+		log.Panicf("extract file=%s err=%v", fn, err)
 	}
 
 	out.Close()
 	in.Close()
 
-	if err = os.Chmod(fn, zf.Mode()); err != nil {
-		log.Printf("set file=%s to mode=%v err=%v", fn, zf.Mode(), err)
+	if err = os.Chmod(fn, ent.Mode); err != nil {
+		log.Printf("set file=%s to mode=%v err=%v", fn, ent.Mode, err)
 	}
 
-	if err = os.Chtimes(fn, zf.ModTime(), zf.ModTime()); err != nil {
-		log.Printf("set file=%s modtime=%v err=%v", fn, zf.ModTime(), err)
+	if err = os.Chtimes(fn, ent.ModTime, ent.ModTime); err != nil {
+		log.Printf("set file=%s modtime=%v err=%v", fn, ent.ModTime, err)
 	}
 }